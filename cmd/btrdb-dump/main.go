@@ -0,0 +1,78 @@
+// Command btrdb-dump writes a portable snapshot of one or more streams
+// to stdout (or a file), for use with btrdb-restore or for archival to
+// object storage. See internal/snapshot for the format.
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/SoftwareDefinedBuildings/btrdb/internal/bstore"
+	"github.com/SoftwareDefinedBuildings/btrdb/internal/snapshot"
+	"github.com/pborman/uuid"
+)
+
+type cliConfig struct {
+	provider string
+	dir      string
+}
+
+func (c *cliConfig) StorageProvider() string { return c.provider }
+func (c *cliConfig) ClusterEnabled() bool    { return c.provider == "ceph" }
+func (c *cliConfig) BlockCache() int         { return 4096 }
+func (c *cliConfig) StorageFilepath() string { return c.dir }
+
+func main() {
+	var (
+		provider = flag.String("provider", "file", "registered storage provider backend to read from")
+		dir      = flag.String("dir", "", "storage directory (file provider only)")
+		uuidList = flag.String("uuids", "", "comma-separated list of stream uuids to export (default: none)")
+		outPath  = flag.String("out", "-", "output path, or - for stdout")
+		toGen    = flag.Uint64("to-generation", bstore.LatestGeneration, "latest generation to include")
+	)
+	flag.Parse()
+
+	if *uuidList == "" {
+		fmt.Fprintln(os.Stderr, "btrdb-dump: at least one -uuids entry is required")
+		os.Exit(2)
+	}
+	var uuids []uuid.UUID
+	for _, s := range strings.Split(*uuidList, ",") {
+		id := uuid.Parse(strings.TrimSpace(s))
+		if id == nil {
+			fmt.Fprintf(os.Stderr, "btrdb-dump: invalid uuid %q\n", s)
+			os.Exit(2)
+		}
+		uuids = append(uuids, id)
+	}
+
+	bs, err := bstore.NewBlockStore(&cliConfig{provider: *provider, dir: *dir})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "btrdb-dump: opening store: %v\n", err)
+		os.Exit(1)
+	}
+
+	out := os.Stdout
+	if *outPath != "-" {
+		f, err := os.Create(*outPath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "btrdb-dump: %v\n", err)
+			os.Exit(1)
+		}
+		defer f.Close()
+		out = f
+	}
+	w := bufio.NewWriter(out)
+	opts := snapshot.Options{ToGeneration: *toGen}
+	if err := snapshot.Export(w, bs, uuids, opts); err != nil {
+		fmt.Fprintf(os.Stderr, "btrdb-dump: %v\n", err)
+		os.Exit(1)
+	}
+	if err := w.Flush(); err != nil {
+		fmt.Fprintf(os.Stderr, "btrdb-dump: %v\n", err)
+		os.Exit(1)
+	}
+}
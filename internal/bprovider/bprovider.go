@@ -0,0 +1,94 @@
+// Package bprovider defines the interface that a btrdb storage backend
+// must implement, and a registry that lets backends make themselves
+// available by name. A backend registers itself from a func init() in
+// its own package, the same way database/sql drivers register
+// themselves with the sql package.
+package bprovider
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/SoftwareDefinedBuildings/btrdb/internal/configprovider"
+)
+
+// StorageProvider is implemented by anything that can durably store the
+// core/vector blocks and per-stream superblocks that make up a btrdb
+// BlockStore.
+type StorageProvider interface {
+	// Initialize prepares the provider for use: opening files, dialing
+	// a cluster, warming pools, etc. It is called once, after the
+	// provider has been constructed by its Factory.
+	Initialize(cfg configprovider.Configuration)
+
+	// CreateDatabase lays down whatever on-disk or on-cluster state is
+	// required before Initialize can succeed against it.
+	CreateDatabase(cfg configprovider.Configuration) error
+
+	// Read fetches the block at addr for the given stream uuid into buf,
+	// returning the populated subslice.
+	Read(uuid []byte, addr uint64, buf []byte) []byte
+	// Write persists data as the block at addr for the given stream uuid.
+	Write(uuid []byte, addr uint64, data []byte)
+
+	GetStreamVersion(uuid []byte) uint64
+	SetStreamVersion(uuid []byte, version uint64)
+
+	ReadSuperBlock(uuid []byte, version uint64, buf []byte) []byte
+	WriteSuperBlock(uuid []byte, version uint64, contents []byte)
+}
+
+// Factory constructs a fresh, uninitialized StorageProvider. Registered
+// factories are expected to be cheap; the real setup work happens in
+// Initialize.
+type Factory func() StorageProvider
+
+var (
+	registryMu sync.RWMutex
+	registry   = make(map[string]Factory)
+)
+
+// Register makes a storage provider backend available under name. It
+// panics if name is empty, factory is nil, or a backend is already
+// registered under name. Register is intended to be called from a
+// package's func init(), not from application code.
+func Register(name string, factory Factory) {
+	if name == "" {
+		panic("bprovider: Register called with empty name")
+	}
+	if factory == nil {
+		panic("bprovider: Register called with nil factory for " + name)
+	}
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	if _, dup := registry[name]; dup {
+		panic("bprovider: Register called twice for backend " + name)
+	}
+	registry[name] = factory
+}
+
+// New constructs a fresh StorageProvider for the named backend. It
+// returns an error if no backend has been registered under that name
+// (usually because the package that registers it was never imported).
+func New(name string) (StorageProvider, error) {
+	registryMu.RLock()
+	factory, ok := registry[name]
+	registryMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("bprovider: unknown storage provider %q (forgotten import?)", name)
+	}
+	return factory(), nil
+}
+
+// Providers returns the names of all currently registered backends, for
+// diagnostics and for tests that want to run the same checks against
+// every backend.
+func Providers() []string {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	names := make([]string, 0, len(registry))
+	for name := range registry {
+		names = append(names, name)
+	}
+	return names
+}
@@ -1,16 +1,22 @@
 package bstore
 
 import (
+	"context"
 	"errors"
 	"os"
 	"sync"
 	"time"
 
 	"github.com/SoftwareDefinedBuildings/btrdb/internal/bprovider"
-	"github.com/SoftwareDefinedBuildings/btrdb/internal/cephprovider"
 	"github.com/SoftwareDefinedBuildings/btrdb/internal/configprovider"
-	"github.com/SoftwareDefinedBuildings/btrdb/internal/fileprovider"
 	"github.com/pborman/uuid"
+
+	// Bundle the built-in backends so that a fresh checkout works out of
+	// the box; each registers itself with bprovider on import. Third
+	// party backends (S3, MinIO, ...) are brought in the same way by
+	// whatever imports them.
+	_ "github.com/SoftwareDefinedBuildings/btrdb/internal/cephprovider"
+	_ "github.com/SoftwareDefinedBuildings/btrdb/internal/fileprovider"
 )
 
 const LatestGeneration = uint64(^(uint64(0)))
@@ -21,9 +27,18 @@ func UUIDToMapKey(id uuid.UUID) [16]byte {
 	return rv
 }
 
+// UUIDKey is the [16]byte form of a stream uuid. Converting once with
+// ToUUIDKey and reusing the result across many ReadDatablockKey calls
+// avoids redoing the uuid.UUID -> []byte conversion per call on hot
+// paths like a tree walk.
+type UUIDKey [16]byte
+
+func ToUUIDKey(id uuid.UUID) UUIDKey {
+	return UUIDKey(UUIDToMapKey(id))
+}
+
 type BlockStore struct {
-	_wlocks map[[16]byte]*sync.Mutex
-	glock   sync.RWMutex
+	wlocks *writeLockManager
 
 	cachemap map[uint64]*CacheItem
 	cacheold *CacheItem
@@ -37,6 +52,28 @@ type BlockStore struct {
 
 	store bprovider.StorageProvider
 	alloc chan uint64
+
+	maintenance *maintenance
+
+	// pending tracks blocks allocated by AllocateCoreblock/
+	// AllocateVectorblock that have not yet been cleared by a successful
+	// Commit, keyed by stream and then by address. A Generation that is
+	// abandoned mid-write (the process crashes, or Commit is never
+	// called) leaves its blocks here past pendingMu's bookkeeping, which
+	// is how the maintenance GC worker finds real reclamation candidates
+	// without needing any enumerate-all-blocks capability from the
+	// storage provider.
+	pendingMu sync.Mutex
+	pending   map[[16]byte]map[uint64]time.Time
+
+	// inFlightFastSyncs holds the still-open Generation for each stream
+	// a fastSyncOne call is partway through transferring, so a retry
+	// after a transient remote error resumes the same Generation (whose
+	// already-allocated block addresses are only meaningful as long as
+	// that Generation itself is still alive) instead of restarting from
+	// persisted state that no longer corresponds to anything real.
+	fastSyncMu        sync.Mutex
+	inFlightFastSyncs map[[16]byte]*Generation
 }
 
 var block_buf_pool = sync.Pool{
@@ -45,6 +82,28 @@ var block_buf_pool = sync.Pool{
 	},
 }
 
+// coreblock_pool and vectorblock_pool are where ReadDatablock takes the
+// block struct for a cache miss. Nothing puts a block back into them, so
+// every Get falls through to New and allocates a fresh, zeroed struct.
+// FreeCoreblock/FreeVectorblock do NOT return blocks here: the struct
+// ReadDatablock returns on a miss is the exact same pointer cachePut
+// then stores under addr, so a caller is never the sole owner of it and
+// has no way to know whether the cache has since evicted it. Recycling
+// on Free without that coordination would let one caller's "done with
+// this block" zero out and overwrite a live cache entry another caller
+// is still reading.
+var coreblock_pool = sync.Pool{
+	New: func() interface{} {
+		return &Coreblock{}
+	},
+}
+
+var vectorblock_pool = sync.Pool{
+	New: func() interface{} {
+		return &Vectorblock{}
+	},
+}
+
 var ErrDatablockNotFound = errors.New("Coreblock not found")
 var ErrGenerationNotFound = errors.New("Generation not found")
 
@@ -58,6 +117,7 @@ type Generation struct {
 	vblocks    []*Vectorblock
 	blockstore *BlockStore
 	flushed    bool
+	lockKey    [16]byte
 }
 
 func (g *Generation) UpdateRootAddr(addr uint64) {
@@ -85,7 +145,9 @@ func (g *Generation) Number() uint64 {
 // }
 func NewBlockStore(cfg configprovider.Configuration) (*BlockStore, error) {
 	bs := BlockStore{}
-	bs._wlocks = make(map[[16]byte]*sync.Mutex)
+	bs.wlocks = newWriteLockManager()
+	bs.pending = make(map[[16]byte]map[uint64]time.Time)
+	bs.inFlightFastSyncs = make(map[[16]byte]*Generation)
 
 	bs.alloc = make(chan uint64, 256)
 	go func() {
@@ -99,11 +161,11 @@ func NewBlockStore(cfg configprovider.Configuration) (*BlockStore, error) {
 		}
 	}()
 
-	if cfg.ClusterEnabled() {
-		bs.store = new(cephprovider.CephStorageProvider)
-	} else {
-		bs.store = new(fileprovider.FileStorageProvider)
+	store, err := bprovider.New(cfg.StorageProvider())
+	if err != nil {
+		return nil, err
 	}
+	bs.store = store
 
 	bs.store.Initialize(cfg)
 	cachesz := cfg.BlockCache()
@@ -116,24 +178,30 @@ func NewBlockStore(cfg configprovider.Configuration) (*BlockStore, error) {
  * This obtains a generation, blocking if necessary
  */
 func (bs *BlockStore) ObtainGeneration(id uuid.UUID) *Generation {
+	//context.Background() never cancels, so the only possible error from
+	//ObtainGenerationCtx can never actually happen here.
+	gen, err := bs.ObtainGenerationCtx(context.Background(), id)
+	if err != nil {
+		lg.Panic(err)
+	}
+	return gen
+}
+
+// ObtainGenerationCtx is ObtainGeneration, but bounded by ctx: if ctx is
+// canceled or times out before the uuid's write lock is free, it returns
+// ctx.Err() instead of blocking forever.
+func (bs *BlockStore) ObtainGenerationCtx(ctx context.Context, id uuid.UUID) (*Generation, error) {
 	//The first thing we do is obtain a write lock on the UUID, as a generation
 	//represents a lock
 	mk := UUIDToMapKey(id)
-	bs.glock.Lock()
-	mtx, ok := bs._wlocks[mk]
-	if !ok {
-		//Mutex doesn't exist so is unlocked
-		mtx = new(sync.Mutex)
-		mtx.Lock()
-		bs._wlocks[mk] = mtx
-	} else {
-		mtx.Lock()
+	if err := bs.wlocks.acquire(mk, ctx.Done()); err != nil {
+		return nil, ctx.Err()
 	}
-	bs.glock.Unlock()
 
 	gen := &Generation{
 		cblocks: make([]*Coreblock, 0, 8192),
 		vblocks: make([]*Vectorblock, 0, 8192),
+		lockKey: mk,
 	}
 	//We need a generation. Lets see if one is on disk
 	existingVer := bs.store.GetStreamVersion(id[:])
@@ -152,7 +220,7 @@ func (bs *BlockStore) ObtainGeneration(id uuid.UUID) *Generation {
 
 	gen.New_SB = gen.Cur_SB.CloneInc()
 	gen.blockstore = bs
-	return gen
+	return gen, nil
 }
 
 //The returned address map is primarily for unit testing
@@ -180,15 +248,19 @@ func (gen *Generation) Commit() (map[uint64]uint64, error) {
 		}
 		log.Critical("Triggered vblock examination: %v blocks, %v points, %v avg", len(gen.vblocks), total, total/len(gen.vblocks))
 	}*/
+	committed := make([]uint64, 0, len(address_map))
+	for transientAddr := range address_map {
+		committed = append(committed, transientAddr)
+	}
+	gen.blockstore.clearPending(gen.New_SB.uuid, committed)
+
 	gen.vblocks = nil
 	gen.cblocks = nil
 
 	gen.blockstore.store.WriteSuperBlock(gen.New_SB.uuid, gen.New_SB.gen, gen.New_SB.Serialize())
 	gen.blockstore.store.SetStreamVersion(gen.New_SB.uuid, gen.New_SB.gen)
 	gen.flushed = true
-	gen.blockstore.glock.RLock()
-	gen.blockstore._wlocks[UUIDToMapKey(*gen.Uuid())].Unlock()
-	gen.blockstore.glock.RUnlock()
+	gen.blockstore.wlocks.release(gen.lockKey)
 	return address_map, nil
 }
 
@@ -208,6 +280,7 @@ func (gen *Generation) AllocateCoreblock() (*Coreblock, error) {
 	cblock.Identifier = gen.blockstore.allocateBlock()
 	cblock.Generation = gen.Number()
 	gen.cblocks = append(gen.cblocks, cblock)
+	gen.blockstore.trackPending(gen.lockKey, cblock.Identifier)
 	return cblock, nil
 }
 
@@ -216,28 +289,101 @@ func (gen *Generation) AllocateVectorblock() (*Vectorblock, error) {
 	vblock.Identifier = gen.blockstore.allocateBlock()
 	vblock.Generation = gen.Number()
 	gen.vblocks = append(gen.vblocks, vblock)
+	gen.blockstore.trackPending(gen.lockKey, vblock.Identifier)
 	return vblock, nil
 }
 
+// trackPending records that addr was allocated for stream key and has
+// not yet been committed, so an abandoned Generation's blocks can later
+// be found by abandonedAllocations and reclaimed.
+func (bs *BlockStore) trackPending(key [16]byte, addr uint64) {
+	bs.pendingMu.Lock()
+	defer bs.pendingMu.Unlock()
+	m, ok := bs.pending[key]
+	if !ok {
+		m = make(map[uint64]time.Time)
+		bs.pending[key] = m
+	}
+	m[addr] = time.Now()
+}
+
+// clearPending marks addrs as no longer pending, either because they
+// were committed or because they were just reclaimed by GC.
+func (bs *BlockStore) clearPending(uuidBytes []byte, addrs []uint64) {
+	key := UUIDToMapKey(uuid.UUID(uuidBytes))
+	bs.pendingMu.Lock()
+	defer bs.pendingMu.Unlock()
+	m, ok := bs.pending[key]
+	if !ok {
+		return
+	}
+	for _, addr := range addrs {
+		delete(m, addr)
+	}
+	if len(m) == 0 {
+		delete(bs.pending, key)
+	}
+}
+
+// abandonedAllocations returns every tracked pending block older than
+// grace, as gcWork ready to push onto the GC queue. It does not clear
+// them; clearPending does that once gcWorker has actually reclaimed the
+// block, so a block that fails to delete is retried rather than lost.
+func (bs *BlockStore) abandonedAllocations(grace time.Duration) []gcWork {
+	cutoff := time.Now().Add(-grace)
+	var work []gcWork
+	bs.pendingMu.Lock()
+	defer bs.pendingMu.Unlock()
+	for key, addrs := range bs.pending {
+		id := make([]byte, 16)
+		copy(id, key[:])
+		for addr, allocatedAt := range addrs {
+			if allocatedAt.Before(cutoff) {
+				work = append(work, gcWork{UUID: id, Addr: addr})
+			}
+		}
+	}
+	return work
+}
+
+// FreeCoreblock nils the caller's pointer. It does not recycle the
+// block into coreblock_pool: the same struct may still be the live
+// cache entry for its address (see coreblock_pool's doc comment), so
+// only something that can prove the block is unreachable, such as a
+// future cache eviction path, may return it to the pool.
 func (bs *BlockStore) FreeCoreblock(cb **Coreblock) {
 	*cb = nil
 }
 
+// FreeVectorblock nils the caller's pointer. It does not recycle the
+// block into vectorblock_pool; see FreeCoreblock.
 func (bs *BlockStore) FreeVectorblock(vb **Vectorblock) {
 	*vb = nil
 }
 
 func (bs *BlockStore) ReadDatablock(uuid uuid.UUID, addr uint64, impl_Generation uint64, impl_Pointwidth uint8, impl_StartTime int64) Datablock {
+	return bs.readDatablock([]byte(uuid), addr, impl_Generation, impl_Pointwidth, impl_StartTime)
+}
+
+// ReadDatablockKey is ReadDatablock for callers that already hold a
+// UUIDKey (see ToUUIDKey), such as a tree walk that issues many reads
+// for the same stream and would otherwise redo the uuid.UUID -> []byte
+// conversion on every one of them.
+func (bs *BlockStore) ReadDatablockKey(key UUIDKey, addr uint64, impl_Generation uint64, impl_Pointwidth uint8, impl_StartTime int64) Datablock {
+	return bs.readDatablock(key[:], addr, impl_Generation, impl_Pointwidth, impl_StartTime)
+}
+
+func (bs *BlockStore) readDatablock(ukey []byte, addr uint64, impl_Generation uint64, impl_Pointwidth uint8, impl_StartTime int64) Datablock {
 	//Try hit the cache first
 	db := bs.cacheGet(addr)
 	if db != nil {
 		return db
 	}
 	syncbuf := block_buf_pool.Get().([]byte)
-	trimbuf := bs.store.Read([]byte(uuid), addr, syncbuf)
+	trimbuf := bs.store.Read(ukey, addr, syncbuf)
 	switch DatablockGetBufferType(trimbuf) {
 	case Core:
-		rv := &Coreblock{}
+		rv := coreblock_pool.Get().(*Coreblock)
 		rv.Deserialize(trimbuf)
 		block_buf_pool.Put(syncbuf)
 		rv.Identifier = addr
@@ -247,7 +393,7 @@ func (bs *BlockStore) ReadDatablock(uuid uuid.UUID, addr uint64, impl_Generation
 		bs.cachePut(addr, rv)
 		return rv
 	case Vector:
-		rv := &Vectorblock{}
+		rv := vectorblock_pool.Get().(*Vectorblock)
 		rv.Deserialize(trimbuf)
 		block_buf_pool.Put(syncbuf)
 		rv.Identifier = addr
@@ -289,22 +435,13 @@ func (bs *BlockStore) LoadSuperblock(id uuid.UUID, generation uint64) *Superbloc
 }
 
 func CreateDatabase(cfg configprovider.Configuration) {
-	if cfg.ClusterEnabled() {
-		cp := new(cephprovider.CephStorageProvider)
-		err := cp.CreateDatabase(cfg)
-		if err != nil {
-			lg.Critical("Error on create: %v", err)
-			os.Exit(1)
-		}
-	} else {
-		if err := os.MkdirAll(cfg.StorageFilepath(), 0755); err != nil {
-			lg.Panic(err)
-		}
-		fp := new(fileprovider.FileStorageProvider)
-		err := fp.CreateDatabase(cfg)
-		if err != nil {
-			lg.Critical("Error on create: %v", err)
-			os.Exit(1)
-		}
+	store, err := bprovider.New(cfg.StorageProvider())
+	if err != nil {
+		lg.Critical("Error on create: %v", err)
+		os.Exit(1)
+	}
+	if err := store.CreateDatabase(cfg); err != nil {
+		lg.Critical("Error on create: %v", err)
+		os.Exit(1)
 	}
 }
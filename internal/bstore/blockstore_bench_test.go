@@ -0,0 +1,101 @@
+package bstore
+
+import (
+	"testing"
+
+	"github.com/pborman/uuid"
+
+	// Registers the "mem" backend used by these benchmarks.
+	_ "github.com/SoftwareDefinedBuildings/btrdb/internal/memprovider"
+)
+
+type benchConfig struct{ cache int }
+
+func (c benchConfig) StorageProvider() string { return "mem" }
+func (c benchConfig) ClusterEnabled() bool    { return false }
+func (c benchConfig) BlockCache() int         { return c.cache }
+func (c benchConfig) StorageFilepath() string { return "" }
+
+func newBenchStore(b *testing.B, cache int) *BlockStore {
+	b.Helper()
+	bs, err := NewBlockStore(benchConfig{cache: cache})
+	if err != nil {
+		b.Fatalf("NewBlockStore: %v", err)
+	}
+	return bs
+}
+
+func commitOneVectorblock(b *testing.B, bs *BlockStore, id uuid.UUID) uint64 {
+	b.Helper()
+	gen := bs.ObtainGeneration(id)
+	vb, err := gen.AllocateVectorblock()
+	if err != nil {
+		b.Fatalf("AllocateVectorblock: %v", err)
+	}
+	gen.UpdateRootAddr(vb.Identifier)
+	addrMap, err := gen.Commit()
+	if err != nil {
+		b.Fatalf("Commit: %v", err)
+	}
+	return addrMap[vb.Identifier]
+}
+
+// benchAllocRuns is the iteration count passed to testing.AllocsPerRun;
+// it is fixed (rather than b.N) so BenchmarkReadDatablockCold can
+// pre-commit exactly this many distinct blocks and guarantee every read
+// is a genuine cache miss.
+const benchAllocRuns = 1000
+
+// BenchmarkReadDatablockHot measures a cache-hit read. A hit is served
+// straight from the cache and never touches the struct pools, so it
+// should not allocate.
+func BenchmarkReadDatablockHot(b *testing.B) {
+	bs := newBenchStore(b, 128)
+	id := uuid.NewRandom()
+	addr := commitOneVectorblock(b, bs, id)
+	bs.ReadDatablock(id, addr, 1, 0, 0) // warm the cache
+
+	allocs := testing.AllocsPerRun(benchAllocRuns, func() {
+		bs.ReadDatablock(id, addr, 1, 0, 0)
+	})
+	b.ReportMetric(allocs, "allocs/op")
+	if allocs > 0 {
+		b.Fatalf("ReadDatablock (cache hit) allocs/op = %v, want 0", allocs)
+	}
+}
+
+// BenchmarkReadDatablockCold measures a cache-miss read: the read buffer
+// comes from block_buf_pool, while the block struct is a fresh allocation
+// (coreblock_pool/vectorblock_pool are never refilled, see
+// coreblock_pool), so this should stay low and flat rather than scaling
+// with traffic.
+func BenchmarkReadDatablockCold(b *testing.B) {
+	bs := newBenchStore(b, 0)
+	id := uuid.NewRandom()
+	addrs := make([]uint64, benchAllocRuns)
+	for i := range addrs {
+		addrs[i] = commitOneVectorblock(b, bs, id)
+	}
+
+	i := 0
+	allocs := testing.AllocsPerRun(benchAllocRuns, func() {
+		bs.ReadDatablock(id, addrs[i], 1, 0, 0)
+		i++
+	})
+	b.ReportMetric(allocs, "allocs/op")
+	if allocs > 2 {
+		b.Fatalf("ReadDatablock (cache miss) allocs/op = %v, want <= 2", allocs)
+	}
+}
+
+// BenchmarkCommitSmall measures the allocation cost of the smallest
+// possible commit: a single freshly-allocated, childless vector block.
+func BenchmarkCommitSmall(b *testing.B) {
+	bs := newBenchStore(b, 128)
+	id := uuid.NewRandom()
+
+	allocs := testing.AllocsPerRun(benchAllocRuns, func() {
+		commitOneVectorblock(b, bs, id)
+	})
+	b.ReportMetric(allocs, "allocs/op")
+}
@@ -0,0 +1,57 @@
+package bstore
+
+import (
+	"testing"
+
+	"github.com/pborman/uuid"
+
+	// Registers the "mem" backend used by this test.
+	_ "github.com/SoftwareDefinedBuildings/btrdb/internal/memprovider"
+)
+
+// TestFreeVectorblockDoesNotCorruptCache guards against FreeVectorblock
+// recycling a block struct that is still the live cache entry for its
+// address: reading a block, freeing it the way the API implies ("done
+// with this block"), then reading an unrelated address must never hand
+// back a struct that aliases (and so can be overwritten under) the first
+// address's still-cached entry.
+func TestFreeVectorblockDoesNotCorruptCache(t *testing.T) {
+	bs, err := NewBlockStore(benchConfig{cache: 128})
+	if err != nil {
+		t.Fatalf("NewBlockStore: %v", err)
+	}
+	id := uuid.NewRandom()
+
+	gen := bs.ObtainGeneration(id)
+	v1, err := gen.AllocateVectorblock()
+	if err != nil {
+		t.Fatalf("AllocateVectorblock: %v", err)
+	}
+	v2, err := gen.AllocateVectorblock()
+	if err != nil {
+		t.Fatalf("AllocateVectorblock: %v", err)
+	}
+	gen.UpdateRootAddr(v1.Identifier)
+	addrMap, err := gen.Commit()
+	if err != nil {
+		t.Fatalf("Commit: %v", err)
+	}
+	addr1 := addrMap[v1.Identifier]
+	addr2 := addrMap[v2.Identifier]
+
+	first := bs.ReadDatablock(id, addr1, 1, 0, 0).(*Vectorblock)
+	bs.FreeVectorblock(&first)
+
+	// Reading a different address must never be handed the struct that
+	// is still cached under addr1, nor may addr1's cache entry come back
+	// zeroed by the free above.
+	second := bs.ReadDatablock(id, addr2, 1, 0, 0).(*Vectorblock)
+	if second.Identifier == addr1 {
+		t.Fatalf("read of addr 0x%x returned the block cached for addr 0x%x", addr2, addr1)
+	}
+
+	reread := bs.ReadDatablock(id, addr1, 1, 0, 0).(*Vectorblock)
+	if reread.Identifier != addr1 {
+		t.Fatalf("re-read of addr 0x%x returned block for addr 0x%x, cache entry was corrupted by FreeVectorblock", addr1, reread.Identifier)
+	}
+}
@@ -0,0 +1,337 @@
+package bstore
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"hash/fnv"
+
+	"github.com/pborman/uuid"
+)
+
+// RemoteBlockStore is the minimal surface a remote btrdb instance must
+// expose for FastSyncFrom to pull a stream's current state without
+// replaying every historical Generation.Commit.
+type RemoteBlockStore interface {
+	// Superblock returns the remote's current superblock for id.
+	Superblock(id uuid.UUID) (*Superblock, error)
+	// EnumerateReachable returns every address reachable from id's
+	// superblock at gen, in post-order (every block's children appear
+	// before the block itself). fastSyncOne rewrites a core block's
+	// child pointers to their local translations as it stores the core
+	// block, so every child must already have a local translation by
+	// the time its parent is processed.
+	EnumerateReachable(id uuid.UUID, gen uint64) ([]uint64, error)
+	// BatchRead returns the raw serialized payload for each address in
+	// addrs, along with the CRC32 (IEEE) of each payload as computed by
+	// the remote, in the same order. fastSyncOne recomputes and compares
+	// these before writing anything locally, the same way snapshot's
+	// readRecord verifies a record's CRC before trusting its payload.
+	BatchRead(id uuid.UUID, addrs []uint64) (payloads [][]byte, crcs []uint32, err error)
+}
+
+// FastSyncOptions tunes a FastSyncFrom call.
+type FastSyncOptions struct {
+	// BatchSize is how many addresses each BatchRead call requests.
+	BatchSize int
+	// InFlight is defaulted by withDefaults but not read by fastSyncOne,
+	// which issues one BatchRead call at a time and waits for its result
+	// before the next; BatchRead calls are never pipelined.
+	InFlight int
+	// FullReplay asks for every historical generation to be preserved
+	// instead of just the current state. No RemoteBlockStore
+	// implementation can satisfy this yet (see fullReplayFrom), so
+	// setting it makes FastSyncFrom fail for every uuid rather than
+	// silently falling back to a fast-sync.
+	FullReplay bool
+}
+
+// FastSyncStats summarizes the result of a FastSyncFrom call.
+type FastSyncStats struct {
+	StreamsSynced     int
+	BlocksTransferred uint64
+	BytesTransferred  uint64
+}
+
+func (o FastSyncOptions) withDefaults() FastSyncOptions {
+	if o.BatchSize <= 0 {
+		o.BatchSize = 256
+	}
+	if o.InFlight <= 0 {
+		o.InFlight = 4
+	}
+	return o
+}
+
+// fastSyncState is the persisted resume point for one in-progress
+// fast-sync job: which remote addresses have already been translated into
+// blocks of the in-flight local Generation, and which are still
+// outstanding.
+type fastSyncState struct {
+	UUID        []byte            `json:"uuid"`
+	Gen         uint64            `json:"gen"`
+	RootAddr    uint64            `json:"root_addr"`
+	Translation map[uint64]uint64 `json:"translation"`
+	Frontier    []uint64          `json:"frontier"`
+}
+
+// fastSyncStateUUID is a reserved, all-0xff stream identifier used to
+// persist fast-sync resume state, mirroring the reserved identifiers
+// (see reservedUUID) the maintenance queues persist under.
+var fastSyncStateUUID = uuid.UUID(bytesRepeat(0xff, 16))
+
+func bytesRepeat(b byte, n int) []byte {
+	buf := make([]byte, n)
+	for i := range buf {
+		buf[i] = b
+	}
+	return buf
+}
+
+// fastSyncStateAddr folds a stream uuid down to a storage address for
+// its resume state. A collision between two streams only costs a wasted
+// re-enumeration on resume, never correctness, since the state record
+// itself carries the uuid it belongs to.
+func fastSyncStateAddr(id uuid.UUID) uint64 {
+	h := fnv.New64a()
+	h.Write(id)
+	return h.Sum64()
+}
+
+func loadFastSyncState(bs *BlockStore, id uuid.UUID) *fastSyncState {
+	buf := bs.store.Read(fastSyncStateUUID, fastSyncStateAddr(id), make([]byte, 0, DBSIZE))
+	if len(buf) == 0 {
+		return nil
+	}
+	var st fastSyncState
+	if err := json.Unmarshal(buf, &st); err != nil || !uuid.Equal(st.UUID, id) {
+		return nil
+	}
+	return &st
+}
+
+func (st *fastSyncState) persist(bs *BlockStore) {
+	buf, err := json.Marshal(st)
+	if err != nil {
+		lg.Critical("fastsync: state marshal failed: %v", err)
+		return
+	}
+	bs.store.Write(fastSyncStateUUID, fastSyncStateAddr(uuid.UUID(st.UUID)), buf)
+}
+
+func (st *fastSyncState) clear(bs *BlockStore) {
+	bs.store.Write(fastSyncStateUUID, fastSyncStateAddr(uuid.UUID(st.UUID)), nil)
+}
+
+// FastSyncFrom replicates uuids from remote into bs without replaying
+// their full commit history: it transfers only the latest superblock
+// plus the blocks reachable from its root. Progress is persisted after
+// every batch, so a retry (after a transient BatchRead error) within the
+// same process resumes from the same frontier instead of starting over.
+// A block is never visible locally until the whole sync finishes and
+// commits, so a process restart before that point simply starts the
+// stream over against the remote's now-current state rather than
+// resuming a partial generation that restart has made meaningless.
+// opts.FullReplay is not yet implemented (see fullReplayFrom) and makes
+// every uuid fail rather than fast-syncing it.
+func (bs *BlockStore) FastSyncFrom(remote RemoteBlockStore, uuids []uuid.UUID, opts FastSyncOptions) (FastSyncStats, error) {
+	opts = opts.withDefaults()
+	var stats FastSyncStats
+	for _, id := range uuids {
+		if opts.FullReplay {
+			if err := bs.fullReplayFrom(remote, id); err != nil {
+				return stats, fmt.Errorf("fastsync: full replay of %s: %w", id.String(), err)
+			}
+			stats.StreamsSynced++
+			continue
+		}
+		n, sz, err := bs.fastSyncOne(remote, id, opts)
+		if err != nil {
+			return stats, fmt.Errorf("fastsync: %s: %w", id.String(), err)
+		}
+		stats.StreamsSynced++
+		stats.BlocksTransferred += n
+		stats.BytesTransferred += sz
+	}
+	return stats, nil
+}
+
+// fastSyncOne pulls id's current state from remote into a single local
+// Generation, the same way importStream (package snapshot) replays a
+// dump: every block is allocated and linked through
+// Generation.AllocateCoreblock/AllocateVectorblock, and only becomes
+// visible once Generation.Commit links and stores it under a real
+// address and swaps the superblock in. This keeps fast-sync under the
+// same per-stream write lock and address-translation guarantees as a
+// normal commit, rather than writing directly to addresses handed out
+// by the transient bs.allocateBlock() channel.
+//
+// A Generation's blocks only have meaningful addresses once Commit
+// resolves them, so persisted Translation entries are only trustworthy
+// while the Generation that produced them is still the one in hand:
+// inFlightFastSyncs keeps that Generation alive (and its write lock
+// held) in memory across retries within this process. If the process
+// restarts, inFlightFastSyncs starts empty, so the stale translation in
+// any leftover persisted state is discarded and the sync starts over
+// against a fresh Generation rather than resolving child pointers
+// against addresses from a Generation that no longer exists.
+func (bs *BlockStore) fastSyncOne(remote RemoteBlockStore, id uuid.UUID, opts FastSyncOptions) (blocks uint64, bytes uint64, rerr error) {
+	sb, err := remote.Superblock(id)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	key := UUIDToMapKey(id)
+	bs.fastSyncMu.Lock()
+	localGen, resuming := bs.inFlightFastSyncs[key]
+	bs.fastSyncMu.Unlock()
+
+	st := loadFastSyncState(bs, id)
+	if !resuming || st == nil || st.Gen != sb.Gen() {
+		if resuming {
+			localGen.abort()
+			bs.fastSyncMu.Lock()
+			delete(bs.inFlightFastSyncs, key)
+			bs.fastSyncMu.Unlock()
+		}
+		frontier, err := remote.EnumerateReachable(id, sb.Gen())
+		if err != nil {
+			return 0, 0, err
+		}
+		st = &fastSyncState{
+			UUID:        id,
+			Gen:         sb.Gen(),
+			RootAddr:    sb.Root(),
+			Translation: make(map[uint64]uint64, len(frontier)),
+			Frontier:    frontier,
+		}
+		localGen, err = bs.ObtainGenerationCtx(context.Background(), id)
+		if err != nil {
+			return 0, 0, err
+		}
+		bs.fastSyncMu.Lock()
+		bs.inFlightFastSyncs[key] = localGen
+		bs.fastSyncMu.Unlock()
+	}
+
+	committed := false
+	defer func() {
+		if committed {
+			bs.fastSyncMu.Lock()
+			delete(bs.inFlightFastSyncs, key)
+			bs.fastSyncMu.Unlock()
+			st.clear(bs)
+		}
+		// On any other outcome, localGen and st are deliberately left in
+		// place: the next call for this uuid resumes them instead of
+		// re-enumerating and re-fetching blocks already translated.
+	}()
+
+	for len(st.Frontier) > 0 {
+		n := min(opts.BatchSize, len(st.Frontier))
+		batchAddrs, rest := st.Frontier[:n], st.Frontier[n:]
+		payloads, crcs, err := remote.BatchRead(id, batchAddrs)
+		if err != nil {
+			return blocks, bytes, err
+		}
+		if len(payloads) != len(batchAddrs) || len(crcs) != len(batchAddrs) {
+			return blocks, bytes, fmt.Errorf("remote returned %d payloads and %d crcs for %d addresses", len(payloads), len(crcs), len(batchAddrs))
+		}
+		for i, payload := range payloads {
+			remoteAddr := batchAddrs[i]
+			localAddr, err := remapAndStore(localGen, payload, crcs[i], st.Translation)
+			if err != nil {
+				return blocks, bytes, fmt.Errorf("block 0x%x: %w", remoteAddr, err)
+			}
+			st.Translation[remoteAddr] = localAddr
+			blocks++
+			bytes += uint64(len(payload))
+		}
+		st.Frontier = rest
+		st.persist(bs)
+	}
+
+	if st.RootAddr != 0 {
+		newRoot, ok := st.Translation[st.RootAddr]
+		if !ok {
+			return blocks, bytes, fmt.Errorf("fastsync: root block 0x%x of %s was never translated", st.RootAddr, id.String())
+		}
+		localGen.UpdateRootAddr(newRoot)
+	}
+	if _, err := localGen.Commit(); err != nil {
+		return blocks, bytes, fmt.Errorf("fastsync: commit of %s: %w", id.String(), err)
+	}
+	committed = true
+	return blocks, bytes, nil
+}
+
+// abort releases gen's write lock without storing or linking any of its
+// blocks, for a fast-sync (or any other Generation user) that needs to
+// give up partway through.
+func (gen *Generation) abort() {
+	if gen.flushed {
+		return
+	}
+	gen.flushed = true
+	gen.vblocks = nil
+	gen.cblocks = nil
+	gen.blockstore.wlocks.release(gen.lockKey)
+}
+
+// remapAndStore verifies payload's CRC32 against crc (mirroring the
+// integrity check snapshot.readRecord performs on every record), then
+// for core blocks rewrites its child pointers from remote addresses to
+// the corresponding local ones, allocates a local block through gen, and
+// returns that block's transient address within gen, which Commit later
+// maps to the real address it stores the block at.
+func remapAndStore(gen *Generation, payload []byte, crc uint32, translation map[uint64]uint64) (uint64, error) {
+	if crc32.ChecksumIEEE(payload) != crc {
+		return 0, fmt.Errorf("crc mismatch, remote block is corrupt or truncated")
+	}
+	switch DatablockGetBufferType(payload) {
+	case Core:
+		cb, err := gen.AllocateCoreblock()
+		if err != nil {
+			return 0, err
+		}
+		cb.Deserialize(payload)
+		for i, childAddr := range cb.Addr {
+			if childAddr == 0 {
+				continue
+			}
+			newChild, ok := translation[childAddr]
+			if !ok {
+				return 0, fmt.Errorf("child 0x%x has no local translation", childAddr)
+			}
+			cb.Addr[i] = newChild
+		}
+		return cb.Identifier, nil
+	case Vector:
+		vb, err := gen.AllocateVectorblock()
+		if err != nil {
+			return 0, err
+		}
+		vb.Deserialize(payload)
+		return vb.Identifier, nil
+	default:
+		return 0, fmt.Errorf("corrupt or unknown block type")
+	}
+}
+
+// fullReplayFrom is meant to replay id's history generation-by-generation
+// instead of transferring only its current state, but RemoteBlockStore
+// has no way to enumerate a stream's past generations or fetch the
+// blocks unique to each one, only its current reachable set. Until
+// RemoteBlockStore grows that capability, fullReplayFrom can only
+// report that it has nothing to replay from.
+func (bs *BlockStore) fullReplayFrom(remote RemoteBlockStore, id uuid.UUID) error {
+	return fmt.Errorf("full generation-by-generation replay of %s is not implemented by this RemoteBlockStore", id.String())
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,228 @@
+package bstore
+
+import (
+	"fmt"
+	"hash/crc32"
+	"testing"
+
+	"github.com/pborman/uuid"
+
+	// Registers the "mem" backend used by these tests.
+	_ "github.com/SoftwareDefinedBuildings/btrdb/internal/memprovider"
+)
+
+// fakeRemoteBlockStore is a RemoteBlockStore backed by an ordinary
+// BlockStore: it serves whatever the "remote" side committed, so a test
+// can build a small tree with the normal ObtainGeneration/Commit path
+// and then fast-sync it into a separate, local BlockStore.
+type fakeRemoteBlockStore struct {
+	bs *BlockStore
+
+	// failAfter, if non-zero, makes the failAfter'th BatchRead call
+	// (1-indexed) return an error instead of data, so a test can
+	// exercise fastSyncOne's resume-from-persisted-frontier path.
+	failAfter int
+	calls     int
+}
+
+func (f *fakeRemoteBlockStore) Superblock(id uuid.UUID) (*Superblock, error) {
+	sb := f.bs.LoadSuperblock(id, LatestGeneration)
+	if sb == nil {
+		return nil, fmt.Errorf("no superblock for %s", id.String())
+	}
+	return sb, nil
+}
+
+// EnumerateReachable walks id's tree in post-order (every child is
+// appended to order before its parent), matching the order
+// RemoteBlockStore.EnumerateReachable's doc comment requires so that
+// fastSyncOne's child-pointer remapping always finds a translation
+// already recorded for every child it looks up.
+func (f *fakeRemoteBlockStore) EnumerateReachable(id uuid.UUID, gen uint64) ([]uint64, error) {
+	sb := f.bs.LoadSuperblock(id, gen)
+	if sb == nil {
+		return nil, fmt.Errorf("no superblock for %s at gen %d", id.String(), gen)
+	}
+	var order []uint64
+	visited := make(map[uint64]bool)
+	var walk func(addr uint64)
+	walk = func(addr uint64) {
+		if addr == 0 || visited[addr] {
+			return
+		}
+		visited[addr] = true
+		db := f.bs.ReadDatablock(id, addr, gen, 0, 0)
+		if cb, ok := db.(*Coreblock); ok {
+			for _, child := range cb.Addr {
+				walk(child)
+			}
+		}
+		order = append(order, addr)
+	}
+	walk(sb.Root())
+	return order, nil
+}
+
+func (f *fakeRemoteBlockStore) BatchRead(id uuid.UUID, addrs []uint64) ([][]byte, []uint32, error) {
+	f.calls++
+	if f.failAfter != 0 && f.calls == f.failAfter {
+		return nil, nil, fmt.Errorf("simulated transient remote failure")
+	}
+	payloads := make([][]byte, len(addrs))
+	crcs := make([]uint32, len(addrs))
+	for i, addr := range addrs {
+		db := f.bs.ReadDatablock(id, addr, 0, 0, 0)
+		var raw []byte
+		switch blk := db.(type) {
+		case *Coreblock:
+			raw = blk.Serialize()
+		case *Vectorblock:
+			raw = blk.Serialize()
+		default:
+			return nil, nil, fmt.Errorf("unknown block type at addr %d", addr)
+		}
+		payloads[i] = raw
+		crcs[i] = crc32.ChecksumIEEE(raw)
+	}
+	return payloads, crcs, nil
+}
+
+// buildRemoteTree commits a small two-level-deep tree (one core
+// block over two vector blocks) on a fresh "remote" BlockStore and
+// returns it along with the stream's uuid.
+func buildRemoteTree(t *testing.T) (*BlockStore, uuid.UUID) {
+	t.Helper()
+	remote, err := NewBlockStore(benchConfig{cache: 128})
+	if err != nil {
+		t.Fatalf("NewBlockStore: %v", err)
+	}
+	id := uuid.NewRandom()
+
+	gen := remote.ObtainGeneration(id)
+	v1, err := gen.AllocateVectorblock()
+	if err != nil {
+		t.Fatalf("AllocateVectorblock: %v", err)
+	}
+	v2, err := gen.AllocateVectorblock()
+	if err != nil {
+		t.Fatalf("AllocateVectorblock: %v", err)
+	}
+	cb, err := gen.AllocateCoreblock()
+	if err != nil {
+		t.Fatalf("AllocateCoreblock: %v", err)
+	}
+	cb.Addr[0] = v1.Identifier
+	cb.Addr[1] = v2.Identifier
+	gen.UpdateRootAddr(cb.Identifier)
+	if _, err := gen.Commit(); err != nil {
+		t.Fatalf("Commit: %v", err)
+	}
+	return remote, id
+}
+
+// TestFastSyncOneResumesFromPersistedFrontier drives fastSyncOne through
+// a simulated remote failure partway through a sync and checks that a
+// second call resumes from the persisted frontier rather than
+// re-enumerating or re-fetching everything, and ends up with a local
+// copy matching the remote.
+func TestFastSyncOneResumesFromPersistedFrontier(t *testing.T) {
+	remote, id := buildRemoteTree(t)
+	remoteSB := remote.LoadSuperblock(id, LatestGeneration)
+
+	local, err := NewBlockStore(benchConfig{cache: 128})
+	if err != nil {
+		t.Fatalf("NewBlockStore: %v", err)
+	}
+
+	fake := &fakeRemoteBlockStore{bs: remote, failAfter: 2}
+	opts := FastSyncOptions{BatchSize: 1}
+
+	if _, _, err := local.fastSyncOne(fake, id, opts); err == nil {
+		t.Fatalf("fastSyncOne: expected simulated failure, got nil error")
+	}
+
+	st := loadFastSyncState(local, id)
+	if st == nil {
+		t.Fatalf("expected fast-sync state to be persisted after a partial failure")
+	}
+	if len(st.Frontier) == 0 {
+		t.Fatalf("expected a non-empty remaining frontier after a partial failure")
+	}
+	callsBeforeResume := fake.calls
+	remaining := len(st.Frontier)
+
+	blocks, _, err := local.fastSyncOne(fake, id, opts)
+	if err != nil {
+		t.Fatalf("fastSyncOne (resume): %v", err)
+	}
+	if fake.calls <= callsBeforeResume {
+		t.Fatalf("resume made no further BatchRead calls")
+	}
+	if blocks != uint64(remaining) {
+		t.Fatalf("resume transferred %d blocks, want %d (only the persisted frontier)", blocks, remaining)
+	}
+
+	if loadFastSyncState(local, id) != nil {
+		t.Fatalf("fast-sync state should be cleared after a successful sync")
+	}
+
+	localSB := local.LoadSuperblock(id, LatestGeneration)
+	if localSB == nil {
+		t.Fatalf("no local superblock after fast-sync")
+	}
+	if localSB.Gen() != remoteSB.Gen() {
+		t.Fatalf("local gen = %d, want %d", localSB.Gen(), remoteSB.Gen())
+	}
+
+	localRoot := local.ReadDatablock(id, localSB.Root(), localSB.Gen(), 0, 0)
+	localCB, ok := localRoot.(*Coreblock)
+	if !ok {
+		t.Fatalf("local root is not a core block")
+	}
+	for _, childAddr := range localCB.Addr {
+		if childAddr == 0 {
+			continue
+		}
+		if db := local.ReadDatablock(id, childAddr, localSB.Gen(), 0, 0); db == nil {
+			t.Fatalf("local child block at 0x%x missing after fast-sync", childAddr)
+		}
+	}
+}
+
+// TestFastSyncOneRejectsCorruptBlock checks that a CRC mismatch on a
+// transferred block is rejected rather than written locally.
+func TestFastSyncOneRejectsCorruptBlock(t *testing.T) {
+	remote, id := buildRemoteTree(t)
+	local, err := NewBlockStore(benchConfig{cache: 128})
+	if err != nil {
+		t.Fatalf("NewBlockStore: %v", err)
+	}
+
+	fake := &fakeRemoteBlockStore{bs: remote}
+	opts := FastSyncOptions{BatchSize: 256}
+	corrupting := &corruptingRemote{fakeRemoteBlockStore: fake}
+
+	if _, _, err := local.fastSyncOne(corrupting, id, opts); err == nil {
+		t.Fatalf("fastSyncOne: expected a CRC mismatch error, got nil")
+	}
+}
+
+// corruptingRemote wraps fakeRemoteBlockStore and flips a byte in every
+// payload it returns, while still reporting the original (correct) CRC
+// — simulating bit-flip corruption in transit.
+type corruptingRemote struct {
+	*fakeRemoteBlockStore
+}
+
+func (c *corruptingRemote) BatchRead(id uuid.UUID, addrs []uint64) ([][]byte, []uint32, error) {
+	payloads, crcs, err := c.fakeRemoteBlockStore.BatchRead(id, addrs)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, p := range payloads {
+		if len(p) > 0 {
+			p[0] ^= 0xff
+		}
+	}
+	return payloads, crcs, nil
+}
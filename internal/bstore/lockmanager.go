@@ -0,0 +1,176 @@
+package bstore
+
+import (
+	"errors"
+	"hash/fnv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var errLockCanceled = errors.New("bstore: write lock acquisition canceled")
+
+// lockManagerShards bounds the contention on any one shard's map mutex;
+// it does not bound memory, which is instead kept flat by removing an
+// entry from its shard the moment nothing holds or waits on it.
+const lockManagerShards = 256
+
+// waitBuckets are the upper bounds, in ascending order, of the
+// contention-wait histogram. The histogram has one extra, final entry
+// that catches everything above waitBuckets[len-1].
+var waitBuckets = [...]time.Duration{
+	time.Millisecond,
+	10 * time.Millisecond,
+	100 * time.Millisecond,
+	time.Second,
+	10 * time.Second,
+}
+
+// LockContentionStats is a snapshot of writeLockManager activity, for
+// operators diagnosing a deployment where many goroutines are competing
+// to write the same streams.
+type LockContentionStats struct {
+	// CurrentHolders is the number of write locks currently held.
+	CurrentHolders int64
+	// WaitHistogram[i] counts acquisitions that waited no longer than
+	// waitBuckets[i] (and longer than waitBuckets[i-1]); the final entry
+	// counts everything longer than the largest bucket.
+	WaitHistogram [len(waitBuckets) + 1]uint64
+}
+
+// lockEntry is a channel-based mutex: Lock takes the single token out of
+// ch (optionally bailing out early via ctx), Unlock puts it back. Unlike
+// sync.Mutex this composes with a context.Context in a select.
+type lockEntry struct {
+	ch   chan struct{}
+	refs int // guarded by the owning lockShard's mu
+}
+
+func newLockEntry() *lockEntry {
+	e := &lockEntry{ch: make(chan struct{}, 1)}
+	e.ch <- struct{}{}
+	return e
+}
+
+func (e *lockEntry) Lock(done <-chan struct{}) error {
+	select {
+	case <-e.ch:
+		return nil
+	case <-done:
+		return errLockCanceled
+	}
+}
+
+func (e *lockEntry) Unlock() {
+	e.ch <- struct{}{}
+}
+
+type lockShard struct {
+	mu      sync.Mutex
+	entries map[[16]byte]*lockEntry
+}
+
+// writeLockManager replaces a single ever-growing map[uuid]*sync.Mutex
+// with N sharded maps, each holding only the entries currently in use.
+// A lock's refcount is incremented while any goroutine holds it or is
+// waiting to, and its entry is deleted from the map the instant that
+// count returns to zero, so memory stays proportional to concurrent
+// writers rather than to every uuid ever written.
+type writeLockManager struct {
+	shards  [lockManagerShards]lockShard
+	holders int64
+	waits   [len(waitBuckets) + 1]uint64
+}
+
+func newWriteLockManager() *writeLockManager {
+	lm := &writeLockManager{}
+	for i := range lm.shards {
+		lm.shards[i].entries = make(map[[16]byte]*lockEntry)
+	}
+	return lm
+}
+
+func (lm *writeLockManager) shardFor(key [16]byte) *lockShard {
+	h := fnv.New32a()
+	h.Write(key[:])
+	return &lm.shards[h.Sum32()%lockManagerShards]
+}
+
+// acquire blocks until key's write lock is held, or done is closed
+// (typically a ctx.Done() channel; pass nil to never bail out early).
+func (lm *writeLockManager) acquire(key [16]byte, done <-chan struct{}) error {
+	shard := lm.shardFor(key)
+
+	shard.mu.Lock()
+	e, ok := shard.entries[key]
+	if !ok {
+		e = newLockEntry()
+		shard.entries[key] = e
+	}
+	e.refs++
+	shard.mu.Unlock()
+
+	start := time.Now()
+	err := e.Lock(done)
+	lm.observeWait(time.Since(start))
+	if err != nil {
+		lm.dropRef(shard, key)
+		return err
+	}
+	atomic.AddInt64(&lm.holders, 1)
+	return nil
+}
+
+// release unlocks key's write lock and drops its refcount.
+func (lm *writeLockManager) release(key [16]byte) {
+	shard := lm.shardFor(key)
+	shard.mu.Lock()
+	e, ok := shard.entries[key]
+	shard.mu.Unlock()
+	if !ok {
+		// Can only happen if release is called without a matching
+		// acquire; a bug in the caller, not a lock manager state we can
+		// recover from silently.
+		lg.Panic("writeLockManager: release of a key with no entry")
+	}
+	e.Unlock()
+	atomic.AddInt64(&lm.holders, -1)
+	lm.dropRef(shard, key)
+}
+
+func (lm *writeLockManager) dropRef(shard *lockShard, key [16]byte) {
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	e, ok := shard.entries[key]
+	if !ok {
+		return
+	}
+	e.refs--
+	if e.refs == 0 {
+		delete(shard.entries, key)
+	}
+}
+
+func (lm *writeLockManager) observeWait(d time.Duration) {
+	for i, bucket := range waitBuckets {
+		if d <= bucket {
+			atomic.AddUint64(&lm.waits[i], 1)
+			return
+		}
+	}
+	atomic.AddUint64(&lm.waits[len(waitBuckets)], 1)
+}
+
+func (lm *writeLockManager) stats() LockContentionStats {
+	st := LockContentionStats{CurrentHolders: atomic.LoadInt64(&lm.holders)}
+	for i := range st.WaitHistogram {
+		st.WaitHistogram[i] = atomic.LoadUint64(&lm.waits[i])
+	}
+	return st
+}
+
+// LockContentionStats reports how much contention writers are seeing on
+// the per-stream write lock.
+func (bs *BlockStore) LockContentionStats() LockContentionStats {
+	return bs.wlocks.stats()
+}
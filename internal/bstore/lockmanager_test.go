@@ -0,0 +1,142 @@
+package bstore
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestWriteLockManagerMutualExclusion drives many goroutines through
+// acquire/release on a handful of keys and checks that at most one
+// holder is ever active per key, the way a correct mutex must.
+func TestWriteLockManagerMutualExclusion(t *testing.T) {
+	lm := newWriteLockManager()
+	const keys = 4
+	const goroutines = 32
+	const itersPerGoroutine = 200
+
+	var active [keys]int32
+	var wg sync.WaitGroup
+	for g := 0; g < goroutines; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < itersPerGoroutine; i++ {
+				key := [16]byte{byte((g + i) % keys)}
+				if err := lm.acquire(key, nil); err != nil {
+					t.Errorf("acquire: %v", err)
+					return
+				}
+				n := atomic.AddInt32(&active[key[0]], 1)
+				if n != 1 {
+					t.Errorf("key %v had %d concurrent holders, want 1", key[0], n)
+				}
+				atomic.AddInt32(&active[key[0]], -1)
+				lm.release(key)
+			}
+		}(g)
+	}
+	wg.Wait()
+}
+
+// TestWriteLockManagerMapCleanup checks that an entry is removed from
+// its shard's map once nothing holds or waits on it, so memory stays
+// proportional to concurrent writers rather than to every uuid ever
+// written.
+func TestWriteLockManagerMapCleanup(t *testing.T) {
+	lm := newWriteLockManager()
+	key := [16]byte{1, 2, 3}
+
+	if err := lm.acquire(key, nil); err != nil {
+		t.Fatalf("acquire: %v", err)
+	}
+	lm.release(key)
+
+	shard := lm.shardFor(key)
+	shard.mu.Lock()
+	_, present := shard.entries[key]
+	shard.mu.Unlock()
+	if present {
+		t.Fatalf("entry for key still present in shard map after release")
+	}
+}
+
+// TestWriteLockManagerCancel checks that acquire bails out via done
+// instead of blocking forever when the lock is already held, and that
+// the canceled waiter's ref doesn't leak an entry behind.
+func TestWriteLockManagerCancel(t *testing.T) {
+	lm := newWriteLockManager()
+	key := [16]byte{9, 9, 9}
+
+	if err := lm.acquire(key, nil); err != nil {
+		t.Fatalf("acquire: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	err := lm.acquire(key, ctx.Done())
+	if err != errLockCanceled {
+		t.Fatalf("acquire with canceled ctx = %v, want errLockCanceled", err)
+	}
+	if time.Since(start) > time.Second {
+		t.Fatalf("acquire took %v to observe cancellation, want well under 1s", time.Since(start))
+	}
+
+	lm.release(key)
+
+	shard := lm.shardFor(key)
+	shard.mu.Lock()
+	e, present := shard.entries[key]
+	refs := -1
+	if present {
+		refs = e.refs
+	}
+	shard.mu.Unlock()
+	if present {
+		t.Fatalf("entry for key still present after release (refs=%d), want removed", refs)
+	}
+}
+
+// TestWriteLockManagerStats checks that LockContentionStats reports a
+// sane holder count and records waits in the histogram.
+func TestWriteLockManagerStats(t *testing.T) {
+	lm := newWriteLockManager()
+	key := [16]byte{5}
+
+	if err := lm.acquire(key, nil); err != nil {
+		t.Fatalf("acquire: %v", err)
+	}
+	if got := lm.stats().CurrentHolders; got != 1 {
+		t.Fatalf("CurrentHolders = %d, want 1", got)
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if err := lm.acquire(key, nil); err != nil {
+			t.Errorf("acquire: %v", err)
+			return
+		}
+		lm.release(key)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	lm.release(key)
+	wg.Wait()
+
+	st := lm.stats()
+	if got := lm.stats().CurrentHolders; got != 0 {
+		t.Fatalf("CurrentHolders after release = %d, want 0", got)
+	}
+	var totalWaits uint64
+	for _, n := range st.WaitHistogram {
+		totalWaits += n
+	}
+	if totalWaits < 2 {
+		t.Fatalf("WaitHistogram recorded %d waits, want at least 2", totalWaits)
+	}
+}
@@ -0,0 +1,482 @@
+package bstore
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pborman/uuid"
+)
+
+// Reserved, non-v4 stream identifiers under which the three maintenance
+// queues persist their state. They can never collide with a real stream
+// uuid, and are distinct from each other so a scrub item can never be
+// popped by the resync or GC worker (or vice versa).
+var (
+	scrubQueueUUID  = reservedUUID(0x73) // 's'
+	resyncQueueUUID = reservedUUID(0x72) // 'r'
+	gcQueueUUID     = reservedUUID(0x67) // 'g'
+)
+
+func reservedUUID(tag byte) uuid.UUID {
+	id := make([]byte, 16)
+	id[0] = tag
+	return uuid.UUID(id)
+}
+
+const maintenanceQueueAddr = uint64(0)
+
+// MaintenanceConfig controls the background maintenance workers started
+// by BlockStore.StartMaintenance.
+type MaintenanceConfig struct {
+	// Streams is the set of streams the producer walks to find blocks to
+	// scrub. Re-walked every ScanInterval (default time.Minute) once its
+	// scrub queue has drained.
+	Streams []uuid.UUID
+	// ScanInterval is how often Streams is re-walked. Zero means
+	// time.Minute.
+	ScanInterval time.Duration
+	// GCGrace is how long a block allocated by Generation.AllocateCoreblock
+	// / AllocateVectorblock may sit without being committed before the GC
+	// worker treats it as abandoned. Zero means 10 minutes.
+	GCGrace time.Duration
+
+	// Scrubbers is the number of goroutines walking allocated blocks and
+	// verifying their checksums.
+	Scrubbers int
+	// ResyncWorkers is the number of goroutines re-replicating
+	// under-replicated blocks. Only meaningful for providers that
+	// implement resyncer.
+	ResyncWorkers int
+	// GCWorkers is the number of goroutines reclaiming blocks left
+	// unreachable by aborted Generation.Commit calls. Only meaningful for
+	// providers that implement deleter.
+	GCWorkers int
+	// RateLimit caps the combined rate, in blocks per second, at which
+	// maintenance work may touch the store. Zero means unlimited.
+	RateLimit float64
+}
+
+func (cfg MaintenanceConfig) scanInterval() time.Duration {
+	if cfg.ScanInterval <= 0 {
+		return time.Minute
+	}
+	return cfg.ScanInterval
+}
+
+func (cfg MaintenanceConfig) gcGrace() time.Duration {
+	if cfg.GCGrace <= 0 {
+		return 10 * time.Minute
+	}
+	return cfg.GCGrace
+}
+
+// MaintenanceStats is a point-in-time snapshot of what the maintenance
+// subsystem has done since it was started.
+type MaintenanceStats struct {
+	BlocksScrubbed    uint64
+	QuarantinedBlocks uint64
+	BlocksResynced    uint64
+	BlocksCollected   uint64
+	ScrubQueueDepth   int
+	ResyncQueueDepth  int
+	GCQueueDepth      int
+}
+
+// resyncer is implemented by storage providers (such as cephprovider)
+// that know how to re-replicate an under-replicated block. Providers
+// that do not implement it simply never receive resync work.
+type resyncer interface {
+	ResyncBlock(uuid []byte, addr uint64) error
+}
+
+// replicationChecker is implemented by storage providers that can report
+// how replicated a block currently is, so the scrubber knows which
+// blocks to hand to the resync queue.
+type replicationChecker interface {
+	ReplicaCount(uuid []byte, addr uint64) (have, want int, err error)
+}
+
+// deleter is implemented by storage providers that can actually reclaim
+// a block's storage. Providers that do not implement it simply never
+// receive GC work (their blocks are only ever marked, never swept).
+type deleter interface {
+	Delete(uuid []byte, addr uint64) error
+}
+
+type scrubWork struct {
+	UUID []byte `json:"uuid"`
+	Addr uint64 `json:"addr"`
+}
+
+type resyncWork struct {
+	UUID []byte `json:"uuid"`
+	Addr uint64 `json:"addr"`
+}
+
+type gcWork struct {
+	UUID []byte `json:"uuid"`
+	Addr uint64 `json:"addr"`
+}
+
+// queueHeader is the only thing persistentQueue keeps at
+// maintenanceQueueAddr: the range of addresses, under the queue's own
+// key, that currently hold live items. Head and Tail only ever grow, so
+// an address is never reused and a Push/Pop never needs to touch any
+// item but the one it's adding or removing.
+type queueHeader struct {
+	Head uint64 `json:"head"`
+	Tail uint64 `json:"tail"`
+}
+
+// persistentQueue is a small FIFO of JSON-encoded work items, keyed by a
+// reserved stream uuid so it round-trips through the block store itself
+// (no separate storage mechanism needed) and resumes after a restart
+// instead of losing its place. Each item is written under its own
+// address (queueHeader.Tail at push time), so Push/Pop only ever
+// rewrite the small header plus the one item touched, rather than the
+// whole queue.
+type persistentQueue struct {
+	mu   sync.Mutex
+	bs   *BlockStore
+	key  uuid.UUID
+	head uint64
+	tail uint64
+}
+
+// firstItemAddr is the first address available for an item; addr 0 is
+// reserved for queueHeader.
+const firstItemAddr = uint64(1)
+
+func newPersistentQueue(bs *BlockStore, key uuid.UUID) *persistentQueue {
+	q := &persistentQueue{bs: bs, key: key, head: firstItemAddr, tail: firstItemAddr}
+	buf := bs.store.Read(key, maintenanceQueueAddr, make([]byte, 0, DBSIZE))
+	if len(buf) > 0 {
+		// A corrupt or foreign header record is not fatal to startup; we
+		// just begin with an empty queue rather than refusing to serve.
+		var hdr queueHeader
+		if err := json.Unmarshal(buf, &hdr); err == nil && hdr.Tail >= hdr.Head {
+			q.head = hdr.Head
+			q.tail = hdr.Tail
+		}
+	}
+	return q
+}
+
+func (q *persistentQueue) persistHeader() {
+	buf, err := json.Marshal(queueHeader{Head: q.head, Tail: q.tail})
+	if err != nil {
+		lg.Critical("maintenance queue header marshal failed: %v", err)
+		return
+	}
+	q.bs.store.Write(q.key, maintenanceQueueAddr, buf)
+}
+
+func (q *persistentQueue) Push(item interface{}) {
+	buf, err := json.Marshal(item)
+	if err != nil {
+		lg.Critical("maintenance queue item marshal failed: %v", err)
+		return
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.bs.store.Write(q.key, q.tail, buf)
+	q.tail++
+	q.persistHeader()
+}
+
+// Pop decodes the oldest item into out (a pointer to a scrubWork,
+// resyncWork or gcWork) and reports whether one was available.
+func (q *persistentQueue) Pop(out interface{}) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.head >= q.tail {
+		return false
+	}
+	buf := q.bs.store.Read(q.key, q.head, make([]byte, 0, DBSIZE))
+	q.head++
+	q.persistHeader()
+	if len(buf) == 0 {
+		lg.Critical("maintenance queue item at addr %d missing or empty", q.head-1)
+		return false
+	}
+	if err := json.Unmarshal(buf, out); err != nil {
+		lg.Critical("maintenance queue item unmarshal failed: %v", err)
+		return false
+	}
+	return true
+}
+
+func (q *persistentQueue) Depth() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return int(q.tail - q.head)
+}
+
+// tokenBucket is a minimal rate limiter: it refills ratePerSec tokens a
+// second, up to ratePerSec (but at least one) in burst, and blocks
+// callers until a token is available. A zero rate disables limiting
+// entirely.
+type tokenBucket struct {
+	rate   float64
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(ratePerSec float64) *tokenBucket {
+	return &tokenBucket{rate: ratePerSec, tokens: ratePerSec, last: time.Now()}
+}
+
+func (t *tokenBucket) Take(ctx context.Context) error {
+	if t.rate <= 0 {
+		return nil
+	}
+	for {
+		t.mu.Lock()
+		now := time.Now()
+		t.tokens += now.Sub(t.last).Seconds() * t.rate
+		burst := t.rate
+		if burst < 1 {
+			burst = 1
+		}
+		if t.tokens > burst {
+			t.tokens = burst
+		}
+		t.last = now
+		if t.tokens >= 1 {
+			t.tokens--
+			t.mu.Unlock()
+			return nil
+		}
+		t.mu.Unlock()
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+// maintenance holds the running state of the background workers started
+// by StartMaintenance.
+type maintenance struct {
+	scrub   *persistentQueue
+	resync  *persistentQueue
+	gc      *persistentQueue
+	limiter *tokenBucket
+	stats   MaintenanceStats
+}
+
+// StartMaintenance spawns cfg's configured pool of background workers to
+// scrub allocated blocks, resync under-replicated ones (where the
+// storage provider supports it) and garbage collect blocks orphaned by
+// aborted commits. A producer goroutine walks cfg.Streams to find blocks
+// to scrub, and scans for commits that were allocated but never landed
+// to find blocks to collect. Work is tracked in persistent, per-purpose
+// queues so a restart resumes rather than rescanning everything. It
+// returns immediately; the workers run until ctx is cancelled.
+func (bs *BlockStore) StartMaintenance(ctx context.Context, cfg MaintenanceConfig) {
+	m := &maintenance{
+		scrub:   newPersistentQueue(bs, scrubQueueUUID),
+		resync:  newPersistentQueue(bs, resyncQueueUUID),
+		gc:      newPersistentQueue(bs, gcQueueUUID),
+		limiter: newTokenBucket(cfg.RateLimit),
+	}
+	bs.maintenance = m
+
+	go bs.maintenanceProducer(ctx, m, cfg)
+	for i := 0; i < cfg.Scrubbers; i++ {
+		go bs.scrubWorker(ctx, m)
+	}
+	for i := 0; i < cfg.ResyncWorkers; i++ {
+		go bs.resyncWorker(ctx, m)
+	}
+	for i := 0; i < cfg.GCWorkers; i++ {
+		go bs.gcWorker(ctx, m)
+	}
+}
+
+// MaintenanceStats returns a snapshot of the background maintenance
+// workers' progress. It is safe to call whether or not maintenance has
+// been started; a store with no maintenance running just reports zeros.
+func (bs *BlockStore) MaintenanceStats() MaintenanceStats {
+	if bs.maintenance == nil {
+		return MaintenanceStats{}
+	}
+	m := bs.maintenance
+	return MaintenanceStats{
+		BlocksScrubbed:    atomic.LoadUint64(&m.stats.BlocksScrubbed),
+		QuarantinedBlocks: atomic.LoadUint64(&m.stats.QuarantinedBlocks),
+		BlocksResynced:    atomic.LoadUint64(&m.stats.BlocksResynced),
+		BlocksCollected:   atomic.LoadUint64(&m.stats.BlocksCollected),
+		ScrubQueueDepth:   m.scrub.Depth(),
+		ResyncQueueDepth:  m.resync.Depth(),
+		GCQueueDepth:      m.gc.Depth(),
+	}
+}
+
+// maintenanceProducer is the "walking allocated block addresses" half of
+// the subsystem: it periodically walks every configured stream's
+// reachable blocks into the scrub queue, and scans for abandoned
+// allocations to feed the GC queue. Each half only runs while its own
+// queue has drained, so a slow scrub or GC pool isn't swamped with
+// duplicate entries for the same block every tick.
+func (bs *BlockStore) maintenanceProducer(ctx context.Context, m *maintenance, cfg MaintenanceConfig) {
+	ticker := time.NewTicker(cfg.scanInterval())
+	defer ticker.Stop()
+	for {
+		if m.scrub.Depth() == 0 {
+			for _, id := range cfg.Streams {
+				if ctx.Err() != nil {
+					return
+				}
+				if err := bs.walkForScrub(id, m.scrub); err != nil {
+					lg.Critical("maintenance: walk of %v failed: %v", id.String(), err)
+				}
+			}
+		}
+		if m.gc.Depth() == 0 {
+			for _, w := range bs.abandonedAllocations(cfg.gcGrace()) {
+				m.gc.Push(w)
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// walkForScrub performs a post-order traversal of every block reachable
+// from id's current superblock, pushing each one onto q.
+func (bs *BlockStore) walkForScrub(id uuid.UUID, q *persistentQueue) error {
+	sb := bs.LoadSuperblock(id, LatestGeneration)
+	if sb == nil {
+		return nil
+	}
+	visited := make(map[uint64]bool)
+	var walk func(addr uint64)
+	walk = func(addr uint64) {
+		if addr == 0 || visited[addr] {
+			return
+		}
+		visited[addr] = true
+		db := bs.ReadDatablock(id, addr, sb.Gen(), 0, 0)
+		if cb, ok := db.(*Coreblock); ok {
+			for _, childAddr := range cb.Addr {
+				walk(childAddr)
+			}
+		}
+		q.Push(scrubWork{UUID: id, Addr: addr})
+	}
+	walk(sb.Root())
+	return nil
+}
+
+func (bs *BlockStore) scrubWorker(ctx context.Context, m *maintenance) {
+	_, canCheckReplication := bs.store.(replicationChecker)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		default:
+		}
+		var w scrubWork
+		if !m.scrub.Pop(&w) {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(time.Second):
+			}
+			continue
+		}
+		if err := m.limiter.Take(ctx); err != nil {
+			return
+		}
+		buf := bs.store.Read(w.UUID, w.Addr, make([]byte, 0, DBSIZE))
+		if buf == nil {
+			atomic.AddUint64(&m.stats.QuarantinedBlocks, 1)
+			lg.Critical("maintenance: quarantining corrupt block %v@%d", uuid.UUID(w.UUID), w.Addr)
+			continue
+		}
+		atomic.AddUint64(&m.stats.BlocksScrubbed, 1)
+		if canCheckReplication {
+			rc := bs.store.(replicationChecker)
+			have, want, err := rc.ReplicaCount(w.UUID, w.Addr)
+			if err == nil && have < want {
+				m.resync.Push(resyncWork{UUID: w.UUID, Addr: w.Addr})
+			}
+		}
+	}
+}
+
+func (bs *BlockStore) resyncWorker(ctx context.Context, m *maintenance) {
+	rs, ok := bs.store.(resyncer)
+	if !ok {
+		// This provider has no notion of replication; nothing to do.
+		return
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		default:
+		}
+		var w resyncWork
+		if !m.resync.Pop(&w) {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(time.Second):
+			}
+			continue
+		}
+		if err := m.limiter.Take(ctx); err != nil {
+			return
+		}
+		if err := rs.ResyncBlock(w.UUID, w.Addr); err != nil {
+			lg.Critical("maintenance: resync of %v@%d failed: %v", uuid.UUID(w.UUID), w.Addr, err)
+			m.resync.Push(w)
+			continue
+		}
+		atomic.AddUint64(&m.stats.BlocksResynced, 1)
+	}
+}
+
+func (bs *BlockStore) gcWorker(ctx context.Context, m *maintenance) {
+	del, ok := bs.store.(deleter)
+	if !ok {
+		// This provider can't reclaim blocks on its own; nothing to do.
+		return
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		default:
+		}
+		var w gcWork
+		if !m.gc.Pop(&w) {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(time.Second):
+			}
+			continue
+		}
+		if err := m.limiter.Take(ctx); err != nil {
+			return
+		}
+		if err := del.Delete(w.UUID, w.Addr); err != nil {
+			lg.Critical("maintenance: gc of %v@%d failed: %v", uuid.UUID(w.UUID), w.Addr, err)
+			m.gc.Push(w)
+			continue
+		}
+		bs.clearPending(w.UUID, []uint64{w.Addr})
+		atomic.AddUint64(&m.stats.BlocksCollected, 1)
+	}
+}
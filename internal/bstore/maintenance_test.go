@@ -0,0 +1,204 @@
+package bstore
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/pborman/uuid"
+
+	// Registers the "mem" backend used by these tests.
+	_ "github.com/SoftwareDefinedBuildings/btrdb/internal/memprovider"
+)
+
+// TestPersistentQueueFIFOAndPersistence checks that a persistentQueue
+// pops items in the order they were pushed, and that a fresh queue
+// opened against the same key resumes from a partially-drained queue
+// instead of losing or reordering the remaining items.
+func TestPersistentQueueFIFOAndPersistence(t *testing.T) {
+	bs, err := NewBlockStore(benchConfig{cache: 128})
+	if err != nil {
+		t.Fatalf("NewBlockStore: %v", err)
+	}
+	key := reservedUUID(0x71) // a throwaway reserved key, distinct from the real queues
+
+	q := newPersistentQueue(bs, key)
+	for i := uint64(0); i < 3; i++ {
+		q.Push(gcWork{UUID: []byte(uuid.NewRandom()), Addr: i})
+	}
+	if got := q.Depth(); got != 3 {
+		t.Fatalf("Depth = %d, want 3", got)
+	}
+
+	var w gcWork
+	if !q.Pop(&w) {
+		t.Fatalf("Pop: expected an item")
+	}
+	if w.Addr != 0 {
+		t.Fatalf("Pop order: got addr %d, want 0 (FIFO)", w.Addr)
+	}
+
+	// A fresh queue instance over the same key must resume with the two
+	// remaining items still queued, in order, not replay the popped one
+	// or lose the unpopped ones.
+	resumed := newPersistentQueue(bs, key)
+	if got := resumed.Depth(); got != 2 {
+		t.Fatalf("resumed Depth = %d, want 2", got)
+	}
+	if !resumed.Pop(&w) || w.Addr != 1 {
+		t.Fatalf("resumed Pop: got %+v, want addr 1", w)
+	}
+	if !resumed.Pop(&w) || w.Addr != 2 {
+		t.Fatalf("resumed Pop: got %+v, want addr 2", w)
+	}
+	if resumed.Pop(&w) {
+		t.Fatalf("Pop: expected queue to be empty")
+	}
+}
+
+// TestMaintenanceProducerDoesNotDuplicateGCWork checks that a block left
+// pending past GCGrace is enqueued for GC exactly once even across
+// several producer ticks, rather than re-enqueued every tick until a
+// (possibly slow) GC worker catches up.
+func TestMaintenanceProducerDoesNotDuplicateGCWork(t *testing.T) {
+	bs, err := NewBlockStore(benchConfig{cache: 128})
+	if err != nil {
+		t.Fatalf("NewBlockStore: %v", err)
+	}
+	id := uuid.NewRandom()
+
+	gen := bs.ObtainGeneration(id)
+	if _, err := gen.AllocateVectorblock(); err != nil {
+		t.Fatalf("AllocateVectorblock: %v", err)
+	}
+	gen.abort() // leaves the allocation pending, as an abandoned commit would
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	cfg := MaintenanceConfig{
+		GCGrace:      time.Millisecond,
+		ScanInterval: 2 * time.Millisecond,
+		// No GCWorkers: nothing ever drains the GC queue, so a producer
+		// that re-enqueues every tick would grow it without bound.
+	}
+	m := &maintenance{
+		scrub:   newPersistentQueue(bs, scrubQueueUUID),
+		resync:  newPersistentQueue(bs, resyncQueueUUID),
+		gc:      newPersistentQueue(bs, gcQueueUUID),
+		limiter: newTokenBucket(cfg.RateLimit),
+	}
+	go bs.maintenanceProducer(ctx, m, cfg)
+
+	time.Sleep(30 * time.Millisecond)
+	cancel()
+	time.Sleep(10 * time.Millisecond) // let the producer observe ctx.Done
+
+	if got := m.gc.Depth(); got != 1 {
+		t.Fatalf("GC queue depth = %d, want 1 (one abandoned block, enqueued once)", got)
+	}
+}
+
+// TestMaintenanceGCReclaimsAbandonedAllocation drives the full
+// StartMaintenance pipeline over a block that was allocated but never
+// committed, and checks that the GC worker actually deletes it (via
+// MemStorageProvider.Delete) and clears it from pending tracking.
+func TestMaintenanceGCReclaimsAbandonedAllocation(t *testing.T) {
+	bs, err := NewBlockStore(benchConfig{cache: 128})
+	if err != nil {
+		t.Fatalf("NewBlockStore: %v", err)
+	}
+	id := uuid.NewRandom()
+
+	gen := bs.ObtainGeneration(id)
+	vb, err := gen.AllocateVectorblock()
+	if err != nil {
+		t.Fatalf("AllocateVectorblock: %v", err)
+	}
+	addr := vb.Identifier
+	gen.abort()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	bs.StartMaintenance(ctx, MaintenanceConfig{
+		GCGrace:      time.Millisecond,
+		ScanInterval: time.Millisecond,
+		GCWorkers:    1,
+	})
+
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		if bs.MaintenanceStats().BlocksCollected >= 1 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if got := bs.MaintenanceStats().BlocksCollected; got != 1 {
+		t.Fatalf("BlocksCollected = %d, want 1", got)
+	}
+	if buf := bs.store.Read([]byte(id), addr, nil); buf != nil {
+		t.Fatalf("block at addr %d still present after GC", addr)
+	}
+
+	bs.pendingMu.Lock()
+	_, stillPending := bs.pending[UUIDToMapKey(id)][addr]
+	bs.pendingMu.Unlock()
+	if stillPending {
+		t.Fatalf("addr %d still tracked as pending after GC reclaimed it", addr)
+	}
+}
+
+// TestMaintenanceScrubWalksCommittedTree checks that StartMaintenance's
+// scrub pool walks every block of a committed stream and counts each as
+// scrubbed.
+func TestMaintenanceScrubWalksCommittedTree(t *testing.T) {
+	bs, err := NewBlockStore(benchConfig{cache: 128})
+	if err != nil {
+		t.Fatalf("NewBlockStore: %v", err)
+	}
+	id := uuid.NewRandom()
+
+	gen := bs.ObtainGeneration(id)
+	v1, err := gen.AllocateVectorblock()
+	if err != nil {
+		t.Fatalf("AllocateVectorblock: %v", err)
+	}
+	v2, err := gen.AllocateVectorblock()
+	if err != nil {
+		t.Fatalf("AllocateVectorblock: %v", err)
+	}
+	cb, err := gen.AllocateCoreblock()
+	if err != nil {
+		t.Fatalf("AllocateCoreblock: %v", err)
+	}
+	cb.Addr[0] = v1.Identifier
+	cb.Addr[1] = v2.Identifier
+	gen.UpdateRootAddr(cb.Identifier)
+	if _, err := gen.Commit(); err != nil {
+		t.Fatalf("Commit: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	bs.StartMaintenance(ctx, MaintenanceConfig{
+		Streams:      []uuid.UUID{id},
+		ScanInterval: time.Millisecond,
+		Scrubbers:    1,
+	})
+
+	deadline := time.Now().Add(time.Second)
+	reached := false
+	for time.Now().Before(deadline) {
+		if bs.MaintenanceStats().BlocksScrubbed >= 3 {
+			reached = true
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	// The producer re-walks the stream on every tick once its scrub
+	// queue drains, so the count only ever grows from here; what
+	// matters is that it reached at least one full walk (root + 2
+	// children) rather than stalling at 0.
+	if !reached {
+		t.Fatalf("BlocksScrubbed = %d, want at least 3 (root + 2 children)", bs.MaintenanceStats().BlocksScrubbed)
+	}
+}
@@ -0,0 +1,7 @@
+package bstore
+
+// Root returns the address of this superblock's root core block.
+func (sb *Superblock) Root() uint64 { return sb.root }
+
+// Gen returns this superblock's generation number.
+func (sb *Superblock) Gen() uint64 { return sb.gen }
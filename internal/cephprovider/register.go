@@ -0,0 +1,9 @@
+package cephprovider
+
+import "github.com/SoftwareDefinedBuildings/btrdb/internal/bprovider"
+
+func init() {
+	bprovider.Register("ceph", func() bprovider.StorageProvider {
+		return new(CephStorageProvider)
+	})
+}
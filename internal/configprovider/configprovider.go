@@ -0,0 +1,21 @@
+// Package configprovider defines the configuration surface that the rest
+// of btrdb reads from, independent of whether it is sourced from a
+// config file, etcd, or flags.
+package configprovider
+
+// Configuration is the configuration surface required to stand up a
+// BlockStore and its storage provider.
+type Configuration interface {
+	// StorageProvider is the registered name of the storage backend to
+	// use (e.g. "ceph", "file", "mem"). See bprovider.Register.
+	StorageProvider() string
+
+	// ClusterEnabled reports whether this node is participating in a
+	// Ceph cluster deployment. Retained for backends and callers that
+	// still branch on it directly; new code should prefer
+	// StorageProvider.
+	ClusterEnabled() bool
+
+	BlockCache() int
+	StorageFilepath() string
+}
@@ -0,0 +1,15 @@
+package fileprovider
+
+import (
+	"os"
+
+	"github.com/SoftwareDefinedBuildings/btrdb/internal/configprovider"
+)
+
+// CreateDatabase lays down the directory FileStorageProvider stores its
+// blocks and superblocks under. Backends with nothing to lay down on
+// local disk (S3, an in-memory store, ...) simply don't need this step,
+// which is why it lives here rather than in bstore.CreateDatabase.
+func (fp *FileStorageProvider) CreateDatabase(cfg configprovider.Configuration) error {
+	return os.MkdirAll(cfg.StorageFilepath(), 0755)
+}
@@ -0,0 +1,9 @@
+package fileprovider
+
+import "github.com/SoftwareDefinedBuildings/btrdb/internal/bprovider"
+
+func init() {
+	bprovider.Register("file", func() bprovider.StorageProvider {
+		return new(FileStorageProvider)
+	})
+}